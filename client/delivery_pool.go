@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultMaxRetries = 8
+	initialBackoff    = 100 * time.Millisecond
+	maxBackoff        = 30 * time.Second
+)
+
+// deliveryTask is a chunk in flight, tagged with how many times it has
+// already been retried and the ackTracker (if any) that acks the
+// QueueStore once every piece of the original Peek has been delivered.
+type deliveryTask struct {
+	chunk   Batch
+	attempt int
+	tracker *ackTracker
+}
+
+// ackTracker acks a single QueueStore.Peek only once every chunk that Peek
+// was split into (by DeliveryPool's too-large handling) has succeeded, and
+// only if none of them were dead-lettered. A dead-lettered chunk is given
+// up on for delivery, but it is deliberately left unacked: acking it would
+// erase the only durable copy of items that were never actually
+// delivered, and DeadLetter()/manual replay is the only way to recover
+// them. The tradeoff is that one poison chunk holds the store's head open
+// behind it — preferring a stalled queue an operator can inspect over
+// silent data loss.
+type ackTracker struct {
+	ack ackFn
+
+	mu      sync.Mutex
+	pending int
+	failed  bool
+}
+
+func newAckTracker(ack ackFn) *ackTracker {
+	if ack == nil {
+		return nil
+	}
+	return &ackTracker{ack: ack, pending: 1}
+}
+
+// split records that one pending piece became n pending pieces.
+func (t *ackTracker) split(n int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.pending += n - 1
+	t.mu.Unlock()
+}
+
+// done records that one piece reached a terminal state, and acks the
+// store once every piece has and none of them were dead-lettered.
+func (t *ackTracker) done(success bool) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !success {
+		t.failed = true
+	}
+	t.pending--
+
+	if t.pending == 0 && !t.failed {
+		if err := t.ack(); err != nil {
+			log.Error().Err(err).Msg("")
+		}
+	}
+}
+
+// serverError wraps the Error string the mock server returns in a
+// ProcessResponse, so deliver can tell a "batch/response too large"
+// rejection apart from a transport failure.
+type serverError struct {
+	msg string
+}
+
+func (e *serverError) Error() string { return e.msg }
+
+// DeliveryPool is a worker pool that fans batches of items out to the
+// upstream server over HTTP. It replaces the single ProcessQueue goroutine
+// with N workers, a shared token-bucket rate limiter, and exponential
+// backoff with a dead letter for chunks that exhaust their retries.
+type DeliveryPool struct {
+	chunks      chan deliveryTask
+	workers     int
+	limiter     *tokenBucket
+	maxRetries  int
+	upstreamURL string
+	onProcessed func(int64)
+
+	inFlight atomic.Int64
+
+	wg       sync.WaitGroup // workers only
+	retrying atomic.Int64   // goroutines spawned by requeue, sleeping out a backoff
+
+	stopOnce    sync.Once
+	draining    chan struct{} // closed first: stops new Enqueues and tells in-flight requeues to prefer the dead letter
+	workersStop chan struct{} // closed once retrying reaches 0: only then is it safe for workers to drain and exit
+
+	deadLetterMu sync.Mutex
+	deadLetter   []Batch
+}
+
+// DeliveryPoolConfig configures a DeliveryPool.
+type DeliveryPoolConfig struct {
+	// Workers is the number of delivery goroutines. Defaults to
+	// runtime.NumCPU()*2 when zero.
+	Workers int
+	// Limits sizes the shared rate limiter.
+	Limits LimitsResponse
+	// MaxRetries is the number of retries before a chunk is dead-lettered.
+	// Defaults to defaultMaxRetries when zero.
+	MaxRetries int
+	// QueueSize is the capacity of the internal FIFO channel. Defaults to
+	// Workers*4 when zero.
+	QueueSize int
+	// UpstreamURL is the base URL chunks are POSTed to. Defaults to
+	// "http://0.0.0.0:8080" when empty.
+	UpstreamURL string
+	// OnProcessed, if set, is called with the size of every chunk the
+	// upstream server accepts.
+	OnProcessed func(int64)
+}
+
+// NewDeliveryPool builds a DeliveryPool from cfg.
+func NewDeliveryPool(cfg DeliveryPoolConfig) *DeliveryPool {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU() * 2
+	}
+
+	maxRetries := cfg.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = workers * 4
+	}
+
+	upstreamURL := cfg.UpstreamURL
+	if upstreamURL == "" {
+		upstreamURL = "http://0.0.0.0:8080"
+	}
+
+	onProcessed := cfg.OnProcessed
+	if onProcessed == nil {
+		onProcessed = func(int64) {}
+	}
+
+	return &DeliveryPool{
+		chunks:      make(chan deliveryTask, queueSize),
+		workers:     workers,
+		limiter:     newTokenBucket(cfg.Limits.Number, cfg.Limits.Duration),
+		maxRetries:  maxRetries,
+		upstreamURL: upstreamURL,
+		onProcessed: onProcessed,
+		draining:    make(chan struct{}),
+		workersStop: make(chan struct{}),
+	}
+}
+
+// Start spawns the pool's worker goroutines, each owning its own
+// *http.Client.
+func (p *DeliveryPool) Start() {
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go p.worker(&http.Client{Timeout: 10 * time.Second})
+	}
+}
+
+// Enqueue submits a chunk of items for delivery. ack, if non-nil, is called
+// once the chunk (and anything it gets split into) has been fully
+// delivered; it is never called if any piece is dead-lettered. Submissions
+// after Drain has started are dropped.
+func (p *DeliveryPool) Enqueue(chunk Batch, ack ackFn) {
+	if len(chunk) == 0 {
+		return
+	}
+
+	select {
+	case <-p.draining:
+		return
+	default:
+	}
+
+	p.inFlight.Add(1)
+	p.chunks <- deliveryTask{chunk: chunk, tracker: newAckTracker(ack)}
+}
+
+// InFlight returns the number of chunks currently enqueued, being sent, or
+// awaiting a retry.
+func (p *DeliveryPool) InFlight() int64 {
+	return p.inFlight.Load()
+}
+
+// drainPollInterval is how often Drain polls p.retrying while waiting for
+// in-flight backoff retries to resolve before letting workers exit.
+const drainPollInterval = time.Millisecond
+
+// Drain stops accepting new chunks and waits for in-flight sends (and any
+// retries they spawn) to finish before returning.
+//
+// Workers must not stop pulling from p.chunks until every requeue goroutine
+// has resolved one way or another: a worker that exited while a backoff
+// retry was about to land a chunk back on p.chunks would leave that chunk
+// buffered behind no reader, silently losing it. So Drain closes draining
+// (which stops new Enqueues and tells requeue to prefer the dead letter over
+// a fresh send) and waits for p.retrying to hit zero *before* closing
+// workersStop, which is the only signal workers actually exit on. p.retrying
+// is a plain counter rather than a WaitGroup because requeue keeps adding to
+// it for the whole lifetime of the pool, including after this wait has
+// started — a WaitGroup forbids exactly that.
+func (p *DeliveryPool) Drain() {
+	p.stopOnce.Do(func() {
+		close(p.draining)
+		for p.retrying.Load() > 0 {
+			time.Sleep(drainPollInterval)
+		}
+		close(p.workersStop)
+	})
+	p.wg.Wait()
+
+	// A send that was already under way when workersStop closed can still
+	// fail and spawn a requeue; with every worker gone, that requeue can
+	// only dead-letter, so wait for it too.
+	for p.retrying.Load() > 0 {
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// DeadLetter returns the chunks that exhausted their retry budget.
+func (p *DeliveryPool) DeadLetter() []Batch {
+	p.deadLetterMu.Lock()
+	defer p.deadLetterMu.Unlock()
+
+	out := make([]Batch, len(p.deadLetter))
+	copy(out, p.deadLetter)
+	return out
+}
+
+func (p *DeliveryPool) worker(client *http.Client) {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case task := <-p.chunks:
+			p.deliver(client, task)
+		case <-p.workersStop:
+			p.drainBuffered(client)
+			return
+		}
+	}
+}
+
+// drainBuffered delivers whatever is still sitting in the channel once the
+// pool has started draining, without blocking for new work.
+func (p *DeliveryPool) drainBuffered(client *http.Client) {
+	for {
+		select {
+		case task := <-p.chunks:
+			p.deliver(client, task)
+		default:
+			return
+		}
+	}
+}
+
+func (p *DeliveryPool) deliver(client *http.Client, task deliveryTask) {
+	defer p.inFlight.Add(-1)
+
+	p.limiter.Wait(len(task.chunk))
+
+	err := sendChunk(client, p.upstreamURL, task.chunk)
+	if err == nil {
+		p.onProcessed(int64(len(task.chunk)))
+		log.Info().Msg("Processed " + strconv.FormatInt(int64(len(task.chunk)), 10) + " items")
+		task.tracker.done(true)
+		return
+	}
+
+	log.Error().Err(err).Msg("")
+
+	var se *serverError
+	if errors.As(err, &se) && (se.msg == errBatchTooLarge || se.msg == errResponseTooLarge) && len(task.chunk) > 1 {
+		mid := len(task.chunk) / 2
+		task.tracker.split(2)
+		p.requeue(deliveryTask{chunk: task.chunk[:mid], tracker: task.tracker}, 0)
+		p.requeue(deliveryTask{chunk: task.chunk[mid:], tracker: task.tracker}, 0)
+		return
+	}
+
+	if task.attempt >= p.maxRetries {
+		p.deadLetterMu.Lock()
+		p.deadLetter = append(p.deadLetter, task.chunk)
+		p.deadLetterMu.Unlock()
+		log.Error().Msg("chunk exhausted retries, moved to dead letter")
+		task.tracker.done(false)
+		return
+	}
+
+	p.requeue(deliveryTask{chunk: task.chunk, attempt: task.attempt + 1, tracker: task.tracker}, backoff(task.attempt))
+}
+
+// requeue schedules task for redelivery after delay. It holds Drain open
+// (via p.retrying) until the chunk is either handed back to the channel or
+// dead-lettered because the pool started draining in the meantime.
+//
+// Whether draining has started is checked once, after the backoff sleep,
+// and that decision is final: if it hasn't, the send to p.chunks is made
+// knowing workers are guaranteed to still be reading it, because Drain
+// doesn't close workersStop until p.retrying (incremented below before the
+// backoff even starts) has dropped back to zero. Racing the draining check
+// against the send itself (as a single select with both cases) is what used
+// to let a task land on the channel after every worker had already exited.
+func (p *DeliveryPool) requeue(task deliveryTask, delay time.Duration) {
+	p.retrying.Add(1)
+	p.inFlight.Add(1)
+
+	go func() {
+		defer p.retrying.Add(-1)
+
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+
+		select {
+		case <-p.draining:
+			p.deadLetterMu.Lock()
+			p.deadLetter = append(p.deadLetter, task.chunk)
+			p.deadLetterMu.Unlock()
+			task.tracker.done(false)
+			p.inFlight.Add(-1)
+		default:
+			p.chunks <- task
+		}
+	}()
+}
+
+// backoff returns a jittered exponential delay for the given retry attempt,
+// bounded by maxBackoff.
+func backoff(attempt int) time.Duration {
+	d := initialBackoff << uint(attempt)
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// sendChunk marshals chunk and POSTs it to upstreamURL, returning a
+// *serverError when the server responds with success=false.
+func sendChunk(client *http.Client, upstreamURL string, chunk Batch) error {
+	jsonData, err := json.Marshal(ProcessRequest{Data: chunk})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, upstreamURL+"/server/process", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var process ProcessResponse
+	if err := json.Unmarshal(body, &process); err != nil {
+		return err
+	}
+
+	if !process.Success {
+		return &serverError{msg: process.Error}
+	}
+
+	return nil
+}
+
+// tokenBucket is a token-bucket rate limiter sized from a LimitsResponse's
+// Number/Duration window, shared by every DeliveryPool worker in place of
+// the previous per-goroutine processedItems map.
+type tokenBucket struct {
+	mu         sync.Mutex
+	capacity   float64
+	tokens     float64
+	refillRate float64 // tokens per nanosecond
+	last       int64
+}
+
+func newTokenBucket(number uint64, duration time.Duration) *tokenBucket {
+	capacity := float64(number)
+	if capacity <= 0 {
+		capacity = 1
+	}
+
+	refillRate := capacity
+	if duration > 0 {
+		refillRate = capacity / float64(duration)
+	}
+
+	return &tokenBucket{
+		capacity:   capacity,
+		tokens:     capacity,
+		refillRate: refillRate,
+		last:       time.Now().UnixNano(),
+	}
+}
+
+// Wait blocks until n tokens are available, then consumes them.
+func (b *tokenBucket) Wait(n int) {
+	for {
+		b.mu.Lock()
+		now := time.Now().UnixNano()
+		b.tokens += float64(now-b.last) * b.refillRate
+		b.last = now
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+
+		if b.tokens >= float64(n) {
+			b.tokens -= float64(n)
+			b.mu.Unlock()
+			return
+		}
+
+		wait := time.Duration((float64(n) - b.tokens) / b.refillRate)
+		b.mu.Unlock()
+
+		time.Sleep(wait)
+	}
+}
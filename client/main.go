@@ -1,14 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"errors"
 	"io"
 	"net/http"
 	"os"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,15 +14,6 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-// Channel is used for stopping goroutine with ProcessQueue
-var Channel chan struct{}
-
-// Queue is a queue for batch items, which is not processed yet
-var Queue SyncQueue
-
-// TotalProcessed is a number of processed items
-var TotalProcessed int
-
 // SyncQueue is a struct for sync queue
 type SyncQueue struct {
 	Batch Batch
@@ -50,38 +39,104 @@ type ProcessResponse struct {
 
 // ProcessResponse is a response data for limits request
 type LimitsResponse struct {
-	Number   uint64        `json:"number"`
-	Duration time.Duration `json:"duration"`
+	Number       uint64        `json:"number"`
+	Duration     time.Duration `json:"duration"`
+	MaxItems     uint64        `json:"max_items"`
+	MaxBodyBytes int64         `json:"max_body_bytes"`
 }
 
+// errBatchTooLarge and errResponseTooLarge are the error strings the mock
+// server returns when a request exceeds its configured MaxItemsPerRequest
+// or MaxBodyBytes. DeliveryPool recognizes them and halves the chunk.
+const (
+	errBatchTooLarge    = "batch too large"
+	errResponseTooLarge = "response too large"
+)
+
 // TotalProcessedResponse is a response data for total request
 type TotalProcessedResponse struct {
-	TotalProcessed int
+	TotalProcessed int64
+}
+
+// Client owns one instance's mutable state: its pending queue store,
+// processed counter, delivery pool, and the goroutine feeding one into the
+// other. Replacing the old package-level globals with this struct lets
+// SetupRoutes mount more than one Client's routes in the same process, e.g.
+// table-driven tests pointing separate clients at separate upstream
+// servers.
+type Client struct {
+	store  QueueStore
+	total  atomic.Int64
+	stop   chan struct{}
+	limits LimitsResponse
+	pool   *DeliveryPool
+
+	httpClient  *http.Client
+	upstreamURL string
+}
+
+// ClientConfig configures a Client.
+type ClientConfig struct {
+	// UpstreamURL is the base URL of the server this Client delivers
+	// batches to, e.g. "http://0.0.0.0:8080". Defaults to that value when
+	// empty.
+	UpstreamURL string
+	// HTTPClient is used for the one-shot /server/limits fetch in
+	// RunProcess. Defaults to a client with a 10s timeout when nil.
+	HTTPClient *http.Client
+	// Store durably holds items between HandleProcess and delivery.
+	// Defaults to a NewMemoryQueueStore when nil.
+	Store QueueStore
+}
+
+// NewClient builds a Client ready for RunProcess.
+func NewClient(cfg ClientConfig) *Client {
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	upstreamURL := cfg.UpstreamURL
+	if upstreamURL == "" {
+		upstreamURL = "http://0.0.0.0:8080"
+	}
+
+	store := cfg.Store
+	if store == nil {
+		store = NewMemoryQueueStore()
+	}
+
+	return &Client{
+		store:       store,
+		stop:        make(chan struct{}),
+		httpClient:  httpClient,
+		upstreamURL: upstreamURL,
+	}
 }
 
 func main() {
 	log.Logger = zerolog.New(os.Stdout).With().Stack().Timestamp().Logger()
 	log.Info().Msg("Client started")
 
-	Channel = make(chan struct{})
-
-	RunProcess()
+	cl := NewClient(ClientConfig{})
+	cl.RunProcess()
 
-	SetupRoutes()
+	SetupRoutes(cl, DefaultServerConfig())
 }
 
-// SetupRoutes runs REST API for client
-func SetupRoutes() {
+// SetupRoutes runs REST API for client, wiring its routes to cl
+func SetupRoutes(cl *Client, cfg ServerConfig) {
 	r := gin.New()
+	r.Use(writeDeadlineMiddleware(cfg))
 	public := r.Group("client")
-	public.POST("/process", HandleProcess)
-	public.GET("/total", HandleTotalProcessed)
-	public.POST("/stop", HandleStop)
+	public.POST("/process", cl.HandleProcess)
+	public.GET("/total", cl.HandleTotalProcessed)
+	public.POST("/stop", cl.HandleStop)
 
 	s := &http.Server{
 		Addr:         "0.0.0.0:8081",
 		ReadTimeout:  100 * time.Second,
-		WriteTimeout: 100 * time.Second,
+		WriteTimeout: cfg.WriteTimeout,
 		Handler:      r,
 	}
 
@@ -90,9 +145,15 @@ func SetupRoutes() {
 	}
 }
 
-// HandleStop is used for stopping RunProcess goroutine via channel
-func HandleStop(c *gin.Context) {
-	Channel <- struct{}{}
+// HandleStop stops the feeder goroutine and gracefully drains the
+// DeliveryPool: no new chunks are accepted, but in-flight sends are given a
+// chance to finish before the request returns.
+func (cl *Client) HandleStop(c *gin.Context) {
+	cl.stop <- struct{}{}
+
+	if cl.pool != nil {
+		cl.pool.Drain()
+	}
 
 	c.JSON(
 		http.StatusOK,
@@ -101,17 +162,20 @@ func HandleStop(c *gin.Context) {
 }
 
 // HandleTotalProcessed is used to see amount of total processed items
-func HandleTotalProcessed(c *gin.Context) {
+func (cl *Client) HandleTotalProcessed(c *gin.Context) {
 	c.JSON(
 		http.StatusOK,
 		TotalProcessedResponse{
-			TotalProcessed: TotalProcessed,
+			TotalProcessed: cl.total.Load(),
 		},
 	)
 }
 
-// HandleProcess is used for adding new items to the processing queue
-func HandleProcess(c *gin.Context) {
+// HandleProcess is used for adding new items to the processing queue. Items
+// are written through cl.store before the 200 is sent, so with a
+// file-backed store a crash after the ACK doesn't lose them; the default
+// MemoryQueueStore holds them only in memory.
+func (cl *Client) HandleProcess(c *gin.Context) {
 	var data ProcessRequest
 	if err := c.ShouldBindJSON(&data); err != nil {
 		log.Error().Err(err).Msg("")
@@ -134,27 +198,32 @@ func HandleProcess(c *gin.Context) {
 		return
 	}
 
-	Queue.Mutex.Lock()
-	Queue.Batch = append(Queue.Batch, data.Data...)
-	Queue.Mutex.Unlock()
+	if err := cl.store.Enqueue(data.Data); err != nil {
+		log.Error().Err(err).Msg("")
+		c.JSON(http.StatusInternalServerError,
+			ProcessResponse{
+				Success: false,
+				Error:   err.Error(),
+			},
+		)
+		return
+	}
 
 	c.JSON(http.StatusOK, ProcessResponse{
 		Success: true,
 	})
 }
 
-// RunProcess gets server limits and starts the goroutine with infinity processing loop
-func RunProcess() {
-	req, err := http.NewRequest(http.MethodGet, "http://0.0.0.0:8080/server/limits", nil)
+// RunProcess gets server limits, starts the DeliveryPool, and launches the
+// feeder goroutine that drains cl's queue into pool-sized chunks.
+func (cl *Client) RunProcess() {
+	req, err := http.NewRequest(http.MethodGet, cl.upstreamURL+"/server/limits", nil)
 	if err != nil {
 		log.Error().Err(err).Msg("")
 		return
 	}
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-	resp, err := client.Do(req)
+	resp, err := cl.httpClient.Do(req)
 	if err != nil {
 		log.Error().Err(err).Msg("")
 		return
@@ -168,113 +237,79 @@ func RunProcess() {
 		return
 	}
 
-	var limits LimitsResponse
-	if err := json.Unmarshal(body, &limits); err != nil {
+	if err := json.Unmarshal(body, &cl.limits); err != nil {
 		log.Error().Err(err).Msg("")
 		return
 	}
 
-	processedItems := make(map[int64]int)
-	errorsCount := 0
-
-	go func() {
-		for {
-			select {
-			case <-Channel:
-				log.Info().Msg("RunProcess has been stopped")
-				return
-			default:
-				if err := ProcessQueue(client, &limits, processedItems); err != nil {
-					errorsCount++
-					log.Error().Err(err).Msg("")
-				} else {
-					errorsCount = 0
-				}
-
-				if errorsCount >= 10 {
-					log.Info().Msg("ProcessQueue returned 10 errors in a row")
-					return
-				}
-			}
-		}
-	}()
-}
+	cl.pool = NewDeliveryPool(DeliveryPoolConfig{
+		Limits:      cl.limits,
+		UpstreamURL: cl.upstreamURL,
+		OnProcessed: func(n int64) { cl.total.Add(n) },
+	})
+	cl.pool.Start()
 
-// ProcessQueue is called for sending queued items to server if channel is not closed
-func ProcessQueue(client *http.Client, limits *LimitsResponse, processedItems map[int64]int) error {
-	if len(Queue.Batch) == 0 {
-		return nil
-	}
+	go cl.feedQueue()
+}
 
-	limit := int(limits.Number)
+// feedQueue repeatedly peeks a chunk sized to cl.limits from cl.store and
+// hands it to cl.pool, until cl.stop is signaled. The peeked items stay in
+// the store until the pool confirms delivery and calls the ack it was
+// handed.
+func (cl *Client) feedQueue() {
+	for {
+		select {
+		case <-cl.stop:
+			log.Info().Msg("RunProcess has been stopped")
+			return
+		default:
+			chunk, ack, err := cl.peekChunk()
+			if err != nil {
+				log.Error().Err(err).Msg("")
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			if chunk == nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
 
-	for timestamp, item := range processedItems {
-		if time.Now().UnixNano() > timestamp+int64(limits.Duration) {
-			delete(processedItems, timestamp)
-		} else {
-			limit -= item
+			cl.pool.Enqueue(chunk, ack)
 		}
 	}
+}
 
-	if limit <= 0 {
-		return nil
-	}
-
-	Queue.Mutex.Lock()
-	if len(Queue.Batch) < limit {
-		limit = len(Queue.Batch)
-	}
-
-	jsonData, err := json.Marshal(
-		ProcessRequest{
-			Data: Queue.Batch[:limit],
-		},
-	)
-	Queue.Mutex.Unlock()
-	if err != nil {
-		return err
-	}
-
-	processedItems[time.Now().UnixNano()] = limit
-
-	req, err := http.NewRequest(http.MethodPost, "http://0.0.0.0:8080/server/process", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Error().Err(err).Msg("")
-		return err
+// peekChunk peeks up to cl.limits.Number items from the front of cl.store
+// (clamped to cl.limits.MaxItems, the server's hard per-request cap).
+func (cl *Client) peekChunk() (Batch, ackFn, error) {
+	limit := int(cl.limits.Number)
+	if cl.limits.MaxItems > 0 && (limit <= 0 || uint64(limit) > cl.limits.MaxItems) {
+		limit = int(cl.limits.MaxItems)
 	}
 
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
+	return cl.store.Peek(limit)
+}
 
-	var process ProcessResponse
-	if err := json.Unmarshal(body, &process); err != nil {
-		return err
-	}
+// waitTimeout bounds Client.Wait so a Client whose RunProcess never
+// started a pool (e.g. the one-shot /server/limits fetch failed) can't
+// block its caller forever.
+const waitTimeout = 10 * time.Second
+
+// Wait blocks until cl.store has drained into the delivery pool and every
+// chunk handed to the pool has resolved, or until waitTimeout elapses.
+// Tests use this in place of sleeping for TotalProcessed to catch up.
+func (cl *Client) Wait() {
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		if cl.store.Len() == 0 && (cl.pool == nil || cl.pool.InFlight() == 0) {
+			return
+		}
 
-	if !process.Success {
-		return errors.New("Error response from server: " + process.Error)
-	}
+		if time.Now().After(deadline) {
+			log.Error().Msg("Wait timed out before the queue drained")
+			return
+		}
 
-	Queue.Mutex.Lock()
-	if len(Queue.Batch) <= limit {
-		Queue.Batch = []Item{}
-	} else {
-		Queue.Batch = Queue.Batch[limit:]
+		time.Sleep(time.Millisecond)
 	}
-	Queue.Mutex.Unlock()
-
-	TotalProcessed += limit
-
-	log.Info().Msg("Processed " + strconv.FormatInt(int64(limit), 10) + " items")
-
-	return nil
 }
@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,9 +23,35 @@ func SetUpRouter() *gin.Engine {
 	return router
 }
 
+// newFakeUpstream spins up an httptest.Server standing in for the mock
+// server's /server/limits and /server/process endpoints, so tests that
+// exercise RunProcess don't depend on a real process listening on the
+// hardcoded 0.0.0.0:8080 default.
+func newFakeUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/server/limits", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(LimitsResponse{
+			Number:       10,
+			Duration:     100 * time.Millisecond,
+			MaxItems:     50,
+			MaxBodyBytes: 1 << 20,
+		})
+	})
+	mux.HandleFunc("/server/process", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ProcessResponse{Success: true})
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
 func TestHandleTotalProcessed(t *testing.T) {
+	cl := NewClient(ClientConfig{})
 	r := SetUpRouter()
-	r.GET("/total", HandleTotalProcessed)
+	r.GET("/total", cl.HandleTotalProcessed)
 
 	req, _ := http.NewRequest("GET", "/total", nil)
 	w := httptest.NewRecorder()
@@ -30,13 +61,14 @@ func TestHandleTotalProcessed(t *testing.T) {
 	var totalProcessedResponse TotalProcessedResponse
 	json.Unmarshal(responseData, &totalProcessedResponse)
 
-	assert.Equal(t, 0, totalProcessedResponse.TotalProcessed)
+	assert.Equal(t, int64(0), totalProcessedResponse.TotalProcessed)
 	assert.Equal(t, http.StatusOK, w.Code)
 }
 
 func TestEmptyRequestHandleProcess(t *testing.T) {
+	cl := NewClient(ClientConfig{})
 	r := SetUpRouter()
-	r.POST("/process", HandleProcess)
+	r.POST("/process", cl.HandleProcess)
 
 	req, _ := http.NewRequest("POST", "/process", nil)
 	w := httptest.NewRecorder()
@@ -52,8 +84,9 @@ func TestEmptyRequestHandleProcess(t *testing.T) {
 }
 
 func TestNoItemsHandleProcess(t *testing.T) {
+	cl := NewClient(ClientConfig{})
 	r := SetUpRouter()
-	r.POST("/process", HandleProcess)
+	r.POST("/process", cl.HandleProcess)
 
 	data := ProcessRequest{Data: []Item{}}
 	jsonData, _ := json.Marshal(data)
@@ -71,11 +104,13 @@ func TestNoItemsHandleProcess(t *testing.T) {
 }
 
 func TestSuccessfulItemsProcessing(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	cl := NewClient(ClientConfig{UpstreamURL: upstream.URL})
 	r := SetUpRouter()
-	r.POST("/process", HandleProcess)
-	r.GET("/total", HandleTotalProcessed)
+	r.POST("/process", cl.HandleProcess)
+	r.GET("/total", cl.HandleTotalProcessed)
 
-	RunProcess()
+	cl.RunProcess()
 
 	data := ProcessRequest{Data: []Item{{}, {}, {}, {}, {}}}
 	jsonData, _ := json.Marshal(data)
@@ -91,7 +126,7 @@ func TestSuccessfulItemsProcessing(t *testing.T) {
 	assert.Equal(t, "", processResponse.Error)
 	assert.Equal(t, http.StatusOK, w.Code)
 
-	time.Sleep(5 * time.Millisecond)
+	cl.Wait()
 
 	req, _ = http.NewRequest("GET", "/total", nil)
 	w = httptest.NewRecorder()
@@ -101,5 +136,325 @@ func TestSuccessfulItemsProcessing(t *testing.T) {
 	var totalProcessedResponse TotalProcessedResponse
 	json.Unmarshal(responseData, &totalProcessedResponse)
 
-	assert.Equal(t, len(data.Data), totalProcessedResponse.TotalProcessed)
+	assert.Equal(t, int64(len(data.Data)), totalProcessedResponse.TotalProcessed)
+}
+
+func TestParallelClientsUseIndependentState(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	clA := NewClient(ClientConfig{UpstreamURL: upstream.URL})
+	clB := NewClient(ClientConfig{UpstreamURL: upstream.URL})
+
+	r := SetUpRouter()
+	r.POST("/a/process", clA.HandleProcess)
+	r.GET("/a/total", clA.HandleTotalProcessed)
+	r.POST("/b/process", clB.HandleProcess)
+	r.GET("/b/total", clB.HandleTotalProcessed)
+
+	clA.RunProcess()
+	clB.RunProcess()
+
+	data := ProcessRequest{Data: []Item{{}, {}, {}}}
+	jsonData, _ := json.Marshal(data)
+	req, _ := http.NewRequest("POST", "/a/process", bytes.NewBuffer(jsonData))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	clA.Wait()
+
+	req, _ = http.NewRequest("GET", "/a/total", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	responseData, _ := ioutil.ReadAll(w.Body)
+	var aTotal TotalProcessedResponse
+	json.Unmarshal(responseData, &aTotal)
+	assert.Equal(t, int64(len(data.Data)), aTotal.TotalProcessed)
+
+	req, _ = http.NewRequest("GET", "/b/total", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	responseData, _ = ioutil.ReadAll(w.Body)
+	var bTotal TotalProcessedResponse
+	json.Unmarshal(responseData, &bTotal)
+	assert.Equal(t, int64(0), bTotal.TotalProcessed)
+}
+
+func TestWriteDeadlineMiddlewareFlushesTimeout(t *testing.T) {
+	r := SetUpRouter()
+	r.Use(writeDeadlineMiddleware(ServerConfig{
+		WriteTimeout: 20 * time.Millisecond,
+		Epsilon:      15 * time.Millisecond,
+	}))
+	r.GET("/slow", func(c *gin.Context) {
+		<-c.Request.Context().Done()
+	})
+
+	req, _ := http.NewRequest("GET", "/slow", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	responseData, _ := ioutil.ReadAll(w.Body)
+	var processResponse ProcessResponse
+	json.Unmarshal(responseData, &processResponse)
+
+	assert.Equal(t, false, processResponse.Success)
+	assert.Equal(t, "timeout", processResponse.Error)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, strconv.Itoa(len(responseData)), w.Header().Get("Content-Length"))
+}
+
+func TestMemoryQueueStorePeekDoesNotRemoveUntilAck(t *testing.T) {
+	s := NewMemoryQueueStore()
+	assert.NoError(t, s.Enqueue(Batch{{}, {}, {}}))
+	assert.Equal(t, 3, s.Len())
+
+	chunk, ack, err := s.Peek(2)
+	assert.NoError(t, err)
+	assert.Len(t, chunk, 2)
+	assert.Equal(t, 3, s.Len())
+
+	assert.NoError(t, ack())
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestFileQueueStorePersistsAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := FileQueueStoreConfig{
+		LogPath:   filepath.Join(dir, "queue.log"),
+		IndexPath: filepath.Join(dir, "queue.idx"),
+		Policy:    FsyncAlways,
+	}
+
+	s, err := NewFileQueueStore(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Enqueue(Batch{{}, {}, {}, {}}))
+	assert.Equal(t, 4, s.Len())
+
+	chunk, ack, err := s.Peek(3)
+	assert.NoError(t, err)
+	assert.Len(t, chunk, 3)
+	assert.NoError(t, ack())
+	assert.Equal(t, 1, s.Len())
+	assert.NoError(t, s.Close())
+
+	restarted, err := NewFileQueueStore(cfg)
+	assert.NoError(t, err)
+	defer restarted.Close()
+
+	assert.Equal(t, 1, restarted.Len())
+	chunk, _, err = restarted.Peek(10)
+	assert.NoError(t, err)
+	assert.Len(t, chunk, 1)
+}
+
+// TestFileQueueStoreIndexWriteLeavesNoTempFile is a regression test for the
+// index being updated via write-to-temp-then-rename instead of an in-place
+// truncating write: ack must leave exactly the index file behind, never a
+// stray temp file that a crash mid-write would otherwise have left around.
+func TestFileQueueStoreIndexWriteLeavesNoTempFile(t *testing.T) {
+	dir := t.TempDir()
+	cfg := FileQueueStoreConfig{
+		LogPath:   filepath.Join(dir, "queue.log"),
+		IndexPath: filepath.Join(dir, "queue.idx"),
+		Policy:    FsyncAlways,
+	}
+
+	s, err := NewFileQueueStore(cfg)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	assert.NoError(t, s.Enqueue(Batch{{}, {}}))
+	_, ack, err := s.Peek(2)
+	assert.NoError(t, err)
+	assert.NoError(t, ack())
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.ElementsMatch(t, []string{"queue.log", "queue.idx"}, names)
+
+	data, err := os.ReadFile(cfg.IndexPath)
+	assert.NoError(t, err)
+	offset, err := strconv.ParseInt(string(data), 10, 64)
+	assert.NoError(t, err)
+	assert.Equal(t, s.head, offset)
+}
+
+func TestAckTrackerWithholdsAckOnDeadLetter(t *testing.T) {
+	s := NewMemoryQueueStore()
+	assert.NoError(t, s.Enqueue(Batch{{}, {}, {}}))
+
+	chunk, ack, err := s.Peek(3)
+	assert.NoError(t, err)
+	assert.Len(t, chunk, 3)
+
+	tracker := newAckTracker(ack)
+	tracker.done(false) // dead-lettered: retries exhausted, never delivered
+
+	assert.Equal(t, 3, s.Len(), "a dead-lettered chunk must not be acked out of the store")
+}
+
+func TestClientPersistsQueueAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := FileQueueStoreConfig{
+		LogPath:   filepath.Join(dir, "queue.log"),
+		IndexPath: filepath.Join(dir, "queue.idx"),
+	}
+
+	store, err := NewFileQueueStore(cfg)
+	assert.NoError(t, err)
+
+	cl := NewClient(ClientConfig{Store: store})
+	r := SetUpRouter()
+	r.POST("/process", cl.HandleProcess)
+
+	data := ProcessRequest{Data: []Item{{}, {}}}
+	jsonData, _ := json.Marshal(data)
+	req, _ := http.NewRequest("POST", "/process", bytes.NewBuffer(jsonData))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, store.Close())
+
+	restarted, err := NewFileQueueStore(cfg)
+	assert.NoError(t, err)
+	defer restarted.Close()
+	assert.Equal(t, 2, restarted.Len())
+}
+
+// closedPortURL returns a URL for a port nothing is listening on, so sends
+// against it fail immediately at the transport level instead of timing out.
+func closedPortURL(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	assert.NoError(t, l.Close())
+
+	return "http://" + addr
+}
+
+// waitForInFlight polls pool.InFlight() until it reaches 0, failing the test
+// if it doesn't within timeout.
+func waitForInFlight(t *testing.T, pool *DeliveryPool, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for pool.InFlight() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("InFlight() still %d after %s", pool.InFlight(), timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDeliveryPoolDeadLettersAfterRetriesExhausted(t *testing.T) {
+	pool := NewDeliveryPool(DeliveryPoolConfig{
+		Workers:     1,
+		MaxRetries:  1,
+		QueueSize:   1,
+		UpstreamURL: closedPortURL(t),
+		Limits:      LimitsResponse{Number: 100, Duration: time.Second},
+	})
+	pool.Start()
+
+	pool.Enqueue(Batch{{}, {}}, nil)
+	waitForInFlight(t, pool, 5*time.Second)
+
+	deadLetter := pool.DeadLetter()
+	assert.Len(t, deadLetter, 1)
+	assert.Len(t, deadLetter[0], 2)
+}
+
+func TestDeliveryPoolSplitsTooLargeChunk(t *testing.T) {
+	var processed atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ProcessRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if len(req.Data) > 1 {
+			json.NewEncoder(w).Encode(ProcessResponse{Success: false, Error: errBatchTooLarge})
+			return
+		}
+		json.NewEncoder(w).Encode(ProcessResponse{Success: true})
+	}))
+	defer srv.Close()
+
+	pool := NewDeliveryPool(DeliveryPoolConfig{
+		Workers:     2,
+		QueueSize:   4,
+		UpstreamURL: srv.URL,
+		Limits:      LimitsResponse{Number: 100, Duration: time.Second},
+		OnProcessed: func(n int64) { processed.Add(n) },
+	})
+	pool.Start()
+
+	pool.Enqueue(Batch{{}, {}}, nil)
+	waitForInFlight(t, pool, 5*time.Second)
+
+	assert.Equal(t, int64(2), processed.Load())
+	assert.Empty(t, pool.DeadLetter())
+}
+
+// TestDeliveryPoolDrainDuringBackoffDoesNotLoseChunks is a regression test
+// for a race where Drain(), called while a chunk was asleep in a backoff
+// retry, could let every worker exit before the retry landed the chunk back
+// on the (now unread) channel, losing it silently: neither delivered, nor
+// dead-lettered, nor reflected in InFlight().
+func TestDeliveryPoolDrainDuringBackoffDoesNotLoseChunks(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		pool := NewDeliveryPool(DeliveryPoolConfig{
+			Workers:     1,
+			MaxRetries:  8,
+			QueueSize:   1,
+			UpstreamURL: closedPortURL(t),
+			Limits:      LimitsResponse{Number: 100, Duration: time.Second},
+		})
+		pool.Start()
+
+		pool.Enqueue(Batch{{}}, nil)
+		time.Sleep(10 * time.Millisecond) // let the first attempt fail and enter backoff
+
+		done := make(chan struct{})
+		go func() {
+			pool.Drain()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Drain() did not return")
+		}
+
+		assert.Equal(t, int64(0), pool.InFlight(), "InFlight must reach 0 once Drain returns")
+		assert.Len(t, pool.DeadLetter(), 1, "the chunk must be accounted for: delivered or dead-lettered, never lost")
+	}
+}
+
+func TestHandleStopDrainsPoolBeforeResponding(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	cl := NewClient(ClientConfig{UpstreamURL: upstream.URL})
+	r := SetUpRouter()
+	r.POST("/process", cl.HandleProcess)
+	r.POST("/stop", cl.HandleStop)
+
+	cl.RunProcess()
+
+	data := ProcessRequest{Data: []Item{{}, {}, {}}}
+	jsonData, _ := json.Marshal(data)
+	req, _ := http.NewRequest("POST", "/process", bytes.NewBuffer(jsonData))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req, _ = http.NewRequest("POST", "/stop", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(0), cl.pool.InFlight(), "HandleStop must not return until the pool has drained")
 }
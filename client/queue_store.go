@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ackFn confirms delivery of the items returned by the Peek call that
+// returned it, letting the store advance its head past those items once
+// every reservation ahead of it has also been acked. A reservation whose
+// chunk is dead-lettered instead of delivered is never acked, so it (and
+// everything reserved after it) stays in the store for inspection or
+// replay. It must be safe to call from a goroutine other than the one that
+// called Peek.
+type ackFn func() error
+
+// QueueStore is the durability boundary between HandleProcess, which writes
+// incoming items through the store before ACKing 200, and the delivery
+// side (the feeder goroutine peeks, the DeliveryPool acks), which only
+// advances the head via ackFn once the upstream server has confirmed a
+// chunk as delivered.
+type QueueStore interface {
+	// Enqueue durably appends batch.
+	Enqueue(batch Batch) error
+	// Peek reserves up to n undelivered items and returns them without
+	// removing them, along with an ackFn that confirms delivery, advancing
+	// the head once every reservation ahead of it has also been acked. A
+	// second Peek call before the first is acked returns the next
+	// reservation, not the same items. A nil chunk (with a nil ackFn) means
+	// every item is either delivered or currently reserved.
+	Peek(n int) (Batch, ackFn, error)
+	// Len reports the number of undelivered items.
+	Len() int
+}
+
+// pendingCommit is one outstanding Peek's reservation: n items starting
+// right after the previous pendingCommit. It is resolved when its ackFn is
+// called, i.e. once every chunk it was split into has been delivered; a
+// reservation that is never acked holds back every one reserved after it.
+// Commits resolve strictly in the order they were reserved, so an
+// ack arriving out of order just marks its entry done and waits for the
+// ones ahead of it.
+type pendingCommit struct {
+	n      int
+	offset int64 // end byte offset of this reservation; unused by MemoryQueueStore
+	done   bool
+}
+
+// MemoryQueueStore is a QueueStore that keeps items only in a SyncQueue,
+// matching the client's pre-persistence behavior: a restart loses whatever
+// hadn't been delivered yet.
+//
+// Peek reserves items without removing them, so a feeder that calls Peek
+// again before the previous chunk is acked gets the next reservation
+// instead of resending the same items; reserved is how many items from
+// the front of Batch are currently out on a reservation.
+type MemoryQueueStore struct {
+	SyncQueue
+	reserved int
+	pending  []*pendingCommit
+}
+
+// NewMemoryQueueStore builds an empty MemoryQueueStore.
+func NewMemoryQueueStore() *MemoryQueueStore {
+	return &MemoryQueueStore{}
+}
+
+// Enqueue implements QueueStore.
+func (s *MemoryQueueStore) Enqueue(batch Batch) error {
+	s.Mutex.Lock()
+	s.Batch = append(s.Batch, batch...)
+	s.Mutex.Unlock()
+	return nil
+}
+
+// Peek implements QueueStore.
+func (s *MemoryQueueStore) Peek(n int) (Batch, ackFn, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	available := len(s.Batch) - s.reserved
+	if available <= 0 {
+		return nil, nil, nil
+	}
+	if n <= 0 || n > available {
+		n = available
+	}
+
+	chunk := make(Batch, n)
+	copy(chunk, s.Batch[s.reserved:s.reserved+n])
+	s.reserved += n
+
+	commit := &pendingCommit{n: n}
+	s.pending = append(s.pending, commit)
+
+	ack := func() error {
+		s.Mutex.Lock()
+		defer s.Mutex.Unlock()
+		commit.done = true
+		for len(s.pending) > 0 && s.pending[0].done {
+			resolved := s.pending[0].n
+			s.Batch = s.Batch[resolved:]
+			s.reserved -= resolved
+			s.pending = s.pending[1:]
+		}
+		return nil
+	}
+
+	return chunk, ack, nil
+}
+
+// Len implements QueueStore.
+func (s *MemoryQueueStore) Len() int {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	return len(s.Batch)
+}
+
+// FsyncPolicy controls how aggressively FileQueueStore flushes its log and
+// index to disk, trading durability for throughput.
+type FsyncPolicy int
+
+const (
+	// FsyncAlways fsyncs the log after every Enqueue and the index after
+	// every ack. Safest, slowest.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncInterval fsyncs both files on a fixed timer instead of per
+	// write.
+	FsyncInterval
+	// FsyncNever never calls Sync explicitly, relying on the OS to flush
+	// the page cache eventually. Fastest, least durable.
+	FsyncNever
+)
+
+// defaultFsyncInterval is how often FsyncInterval flushes when the caller
+// doesn't override it.
+const defaultFsyncInterval = time.Second
+
+// FileQueueStore is a QueueStore backed by an append-only log: one
+// JSON-encoded Item per line. A companion index file holds the byte offset
+// of the current head, so that on startup NewFileQueueStore can skip
+// straight to the first undelivered item instead of replaying the whole
+// log — this is what lets RunProcess pick up items that were queued before
+// a crash.
+//
+// Peek reserves items starting after reservedOffset without advancing
+// head, so concurrent Peeks (or a feeder that calls Peek again before a
+// chunk is acked) each get a fresh range instead of resending the same
+// items. head only advances when pending's reservations resolve in the
+// order they were made — reservedCount (in items) and pending's offsets
+// (in bytes) are not persisted, so a crash before an ack simply makes the
+// unacked tail look unreserved again on restart.
+type FileQueueStore struct {
+	mu sync.Mutex
+
+	log       *os.File
+	indexPath string
+
+	head           int64 // byte offset of the first unacked item in the log
+	size           int   // item count from head to end-of-log
+	reservedOffset int64 // byte offset of the first unreserved item
+	reservedCount  int   // item count from head to reservedOffset
+	pending        []*pendingCommit
+
+	policy FsyncPolicy
+	stop   chan struct{}
+}
+
+// FileQueueStoreConfig configures a FileQueueStore.
+type FileQueueStoreConfig struct {
+	// LogPath is the append-only log file, created if missing.
+	LogPath string
+	// IndexPath is the file recording the log's head offset, created if
+	// missing.
+	IndexPath string
+	// Policy controls how aggressively the store fsyncs. Defaults to
+	// FsyncAlways.
+	Policy FsyncPolicy
+	// FsyncInterval is the flush period used by FsyncInterval. Defaults to
+	// defaultFsyncInterval when zero.
+	FsyncInterval time.Duration
+}
+
+// NewFileQueueStore opens (or creates) the log and index files at
+// cfg.LogPath/cfg.IndexPath and seeks to the recorded head, recovering
+// whatever was queued before a restart.
+func NewFileQueueStore(cfg FileQueueStoreConfig) (*FileQueueStore, error) {
+	log, err := os.OpenFile(cfg.LogPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := readIndex(cfg.IndexPath)
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	s := &FileQueueStore{
+		log:            log,
+		indexPath:      cfg.IndexPath,
+		head:           head,
+		reservedOffset: head,
+		policy:         cfg.Policy,
+		stop:           make(chan struct{}),
+	}
+
+	size, err := s.countFromHead()
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	s.size = size
+
+	if s.policy == FsyncInterval {
+		interval := cfg.FsyncInterval
+		if interval <= 0 {
+			interval = defaultFsyncInterval
+		}
+		go s.syncLoop(interval)
+	}
+
+	return s, nil
+}
+
+func readIndex(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	offset, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// writeIndex durably replaces the index file with offset. It writes to a
+// temp file in the same directory and renames it over indexPath, so a crash
+// mid-write leaves either the old index or the new one, never a partial
+// file readIndex can't parse on the next startup.
+func (s *FileQueueStore) writeIndex(offset int64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.indexPath), filepath.Base(s.indexPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strconv.FormatInt(offset, 10)); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if s.policy == FsyncAlways {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.indexPath)
+}
+
+// countFromHead scans the log from s.head to EOF to recover the item count
+// a fresh process otherwise has no record of.
+func (s *FileQueueStore) countFromHead() (int, error) {
+	if _, err := s.log.Seek(s.head, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(s.log)
+	count := 0
+	for scanner.Scan() {
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	if _, err := s.log.Seek(0, io.SeekEnd); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (s *FileQueueStore) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			s.log.Sync()
+			if index, err := os.Open(s.indexPath); err == nil {
+				index.Sync()
+				index.Close()
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close stops the background fsync loop, if any, and closes the log file.
+func (s *FileQueueStore) Close() error {
+	close(s.stop)
+	return s.log.Close()
+}
+
+// Enqueue implements QueueStore.
+func (s *FileQueueStore) Enqueue(batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := bufio.NewWriter(s.log)
+	for _, item := range batch {
+		line, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		if err := w.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	s.size += len(batch)
+
+	if s.policy == FsyncAlways {
+		return s.log.Sync()
+	}
+	return nil
+}
+
+// Peek implements QueueStore. It reads n items starting at reservedOffset
+// without advancing head; the returned ackFn resolves this reservation and
+// writes the new head to the index file once every reservation ahead of it
+// has also resolved.
+func (s *FileQueueStore) Peek(n int) (Batch, ackFn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	available := s.size - s.reservedCount
+	if available <= 0 {
+		return nil, nil, nil
+	}
+	if n <= 0 || n > available {
+		n = available
+	}
+
+	if _, err := s.log.Seek(s.reservedOffset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(s.log)
+	chunk := make(Batch, 0, n)
+	offset := s.reservedOffset
+
+	for i := 0; i < n; i++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+
+		var item Item
+		if len(line) > 0 {
+			trimmed := line
+			if trimmed[len(trimmed)-1] == '\n' {
+				trimmed = trimmed[:len(trimmed)-1]
+			}
+			if err := json.Unmarshal(trimmed, &item); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		chunk = append(chunk, item)
+		offset += int64(len(line))
+	}
+
+	if _, err := s.log.Seek(0, io.SeekEnd); err != nil {
+		return nil, nil, err
+	}
+
+	s.reservedOffset = offset
+	s.reservedCount += n
+
+	commit := &pendingCommit{n: n, offset: offset}
+	s.pending = append(s.pending, commit)
+
+	ack := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		commit.done = true
+		for len(s.pending) > 0 && s.pending[0].done {
+			resolved := s.pending[0]
+			s.head = resolved.offset
+			s.size -= resolved.n
+			s.reservedCount -= resolved.n
+			s.pending = s.pending[1:]
+
+			if err := s.writeIndex(s.head); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return chunk, ack, nil
+}
+
+// Len implements QueueStore.
+func (s *FileQueueStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
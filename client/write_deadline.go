@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServerConfig configures the HTTP server SetupRoutes builds, including the
+// point at which the write-deadline middleware preempts an in-flight
+// response.
+type ServerConfig struct {
+	// WriteTimeout is passed straight through to http.Server.WriteTimeout.
+	WriteTimeout time.Duration
+	// Epsilon is how long before WriteTimeout the middleware gives up on
+	// the handler and flushes a timeout response of its own.
+	Epsilon time.Duration
+}
+
+// DefaultServerConfig mirrors the client's previous hardcoded 100s timeout.
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		WriteTimeout: 100 * time.Second,
+		Epsilon:      2 * time.Second,
+	}
+}
+
+// writeDeadlineMiddleware guards against http.Server.WriteTimeout firing
+// mid-response: WriteTimeout closes the connection outright, which would
+// truncate a partially written JSON body and hang the client. A timer set
+// to WriteTimeout-Epsilon gives the handler a last chance to finish, and
+// otherwise takes over the response itself: a fixed Content-Length is set,
+// chunked/gzip encoding is stripped so net/http can't append a trailing
+// chunk that never gets written, a ProcessResponse{Success:false,
+// Error:"timeout"} is flushed, and the request context is canceled so the
+// handler goroutine can abort.
+func writeDeadlineMiddleware(cfg ServerConfig) gin.HandlerFunc {
+	deadline := cfg.WriteTimeout - cfg.Epsilon
+
+	return func(c *gin.Context) {
+		tw := &timeoutWriter{ResponseWriter: c.Writer}
+		c.Writer = tw
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		c.Request = c.Request.WithContext(ctx)
+
+		timer := time.AfterFunc(deadline, func() {
+			tw.timeout()
+			cancel()
+		})
+		defer timer.Stop()
+		defer cancel()
+
+		c.Next()
+	}
+}
+
+// timeoutWriter wraps gin.ResponseWriter so a timer goroutine can flush a
+// fixed-size timeout response and mute any write the handler attempts
+// afterwards.
+type timeoutWriter struct {
+	gin.ResponseWriter
+
+	mu       sync.Mutex
+	timedOut bool
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ResponseWriter.Header()
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// timeout flushes the fixed-size timeout body, unless the handler already
+// wrote a response of its own.
+func (w *timeoutWriter) timeout() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timedOut || w.ResponseWriter.Written() {
+		return
+	}
+	w.timedOut = true
+
+	body, err := json.Marshal(ProcessResponse{Success: false, Error: "timeout"})
+	if err != nil {
+		return
+	}
+
+	header := w.ResponseWriter.Header()
+	header.Del("Content-Encoding")
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Type", "application/json; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	w.ResponseWriter.WriteHeader(http.StatusGatewayTimeout)
+	w.ResponseWriter.Write(body)
+}
@@ -18,9 +18,22 @@ var BatchLengthLimit uint64
 // Duration for batch limit
 var Duration time.Duration
 
+// MaxItemsPerRequest is a hard cap on the number of items a single
+// /server/process request may carry, independent of BatchLengthLimit.
+var MaxItemsPerRequest uint64
+
+// MaxBodyBytes is a hard cap on the size of a /server/process request body.
+var MaxBodyBytes int64
+
 // ErrBlocked reports if service is blocked.
 var ErrBlocked = errors.New("blocked")
 
+// ErrBatchTooLarge reports that a request carried more items than MaxItemsPerRequest.
+var ErrBatchTooLarge = errors.New("batch too large")
+
+// ErrResponseTooLarge reports that a request body exceeded MaxBodyBytes.
+var ErrResponseTooLarge = errors.New("response too large")
+
 // Service defines external service that can process batches of items.
 type Service interface {
 	GetLimits() (n uint64, p time.Duration)
@@ -34,8 +47,10 @@ type Batch []Item
 type Item struct{}
 
 type GetLimitsResponse struct {
-	Number   uint64        `json:"number"`
-	Duration time.Duration `json:"duration"`
+	Number       uint64        `json:"number"`
+	Duration     time.Duration `json:"duration"`
+	MaxItems     uint64        `json:"max_items"`
+	MaxBodyBytes int64         `json:"max_body_bytes"`
 }
 
 type ProcessRequest struct {
@@ -66,6 +81,8 @@ func main() {
 
 	Duration = 15 * time.Second
 	BatchLengthLimit = uint64(10)
+	MaxItemsPerRequest = uint64(50)
+	MaxBodyBytes = int64(1 << 20) // 1MB
 
 	r := gin.New()
 	public := r.Group("server")
@@ -88,18 +105,34 @@ func HandleGetLimits(c *gin.Context) {
 	p, n := GetLimits(Batch{})
 
 	c.JSON(http.StatusOK, GetLimitsResponse{
-		Number:   p,
-		Duration: n,
+		Number:       p,
+		Duration:     n,
+		MaxItems:     MaxItemsPerRequest,
+		MaxBodyBytes: MaxBodyBytes,
 	})
 }
 
 func HandleProcess(c *gin.Context) {
+	if MaxBodyBytes > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxBodyBytes)
+	}
+
 	var data ProcessRequest
 	if err := c.ShouldBindJSON(&data); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			ErrorResponse(c, ErrResponseTooLarge)
+			return
+		}
 		ErrorResponse(c, err)
 		return
 	}
 
+	if MaxItemsPerRequest > 0 && uint64(len(data.Data)) > MaxItemsPerRequest {
+		ErrorResponse(c, ErrBatchTooLarge)
+		return
+	}
+
 	if err := Process(Batch{}, data.Data); err != nil {
 		ErrorResponse(c, err)
 		return
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func SetUpRouter() *gin.Engine {
+	router := gin.Default()
+	router.POST("/server/process", HandleProcess)
+	return router
+}
+
+func TestHandleProcessEnforcesLimits(t *testing.T) {
+	oldBatchLengthLimit, oldMaxItems, oldMaxBodyBytes := BatchLengthLimit, MaxItemsPerRequest, MaxBodyBytes
+	BatchLengthLimit = 10
+	MaxItemsPerRequest = 3
+	MaxBodyBytes = 200
+	defer func() {
+		BatchLengthLimit, MaxItemsPerRequest, MaxBodyBytes = oldBatchLengthLimit, oldMaxItems, oldMaxBodyBytes
+	}()
+
+	tests := []struct {
+		name       string
+		body       []byte
+		wantError  string
+		wantStatus int
+	}{
+		{
+			name:       "within both limits",
+			body:       mustMarshal(t, ProcessRequest{Data: Batch{{}, {}}}),
+			wantError:  "",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "too many items",
+			body:       mustMarshal(t, ProcessRequest{Data: Batch{{}, {}, {}, {}}}),
+			wantError:  ErrBatchTooLarge.Error(),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "body too large",
+			body:       []byte(`{"padding":"` + strings.Repeat("x", int(MaxBodyBytes)) + `"}`),
+			wantError:  ErrResponseTooLarge.Error(),
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	r := SetUpRouter()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/server/process", bytes.NewBuffer(tt.body))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			responseData, _ := ioutil.ReadAll(w.Body)
+			var resp ProcessResponse
+			json.Unmarshal(responseData, &resp)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantError, resp.Error)
+		})
+	}
+}
+
+// TestHandleProcessEnforcesMaxBodyBytesWithoutContentLength is a regression
+// test: ContentLength is -1 for a chunked (or otherwise length-unspecified)
+// request, so a check against it alone lets an oversized body straight
+// through to ShouldBindJSON. HandleProcess must enforce MaxBodyBytes on the
+// bytes actually read instead.
+func TestHandleProcessEnforcesMaxBodyBytesWithoutContentLength(t *testing.T) {
+	oldMaxBodyBytes := MaxBodyBytes
+	MaxBodyBytes = 200
+	defer func() { MaxBodyBytes = oldMaxBodyBytes }()
+
+	body := []byte(`{"padding":"` + strings.Repeat("x", int(MaxBodyBytes)) + `"}`)
+
+	r := SetUpRouter()
+	req, _ := http.NewRequest("POST", "/server/process", bytes.NewBuffer(body))
+	req.ContentLength = -1 // what net/http sets for a chunked request
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	responseData, _ := ioutil.ReadAll(w.Body)
+	var resp ProcessResponse
+	json.Unmarshal(responseData, &resp)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, ErrResponseTooLarge.Error(), resp.Error)
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	assert.NoError(t, err)
+	return data
+}